@@ -0,0 +1,113 @@
+package shadowstream
+
+import (
+	"crypto/cipher"
+	"crypto/sha1"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxAEADChunkSize 是单个 AEAD chunk 的最大明文长度，和 v2ray/shadowaead 的
+// chunk 格式保持一致（2 字节长度域的高两位固定为 0）。
+const maxAEADChunkSize = 0x3FFF
+
+// AEADConstructor 根据子密钥构造一个 AEAD，用于 WithAEADFraming。
+type AEADConstructor func(key []byte) (cipher.AEAD, error)
+
+// aeadSubkeyInfo 是派生 AEAD 子密钥用的 HKDF info。同一条物理流的 body
+// key/salt 在 WriteHeader（发送端）和 readResponse（接收端）必须派生出同一个
+// 子密钥，所以这里不按本地调用的是 Read 还是 Write 来区分 info —— 两个方向
+// 的区分已经由各自独立的 bodyIV/bodyPassword 保证了。
+const aeadSubkeyInfo = "ss-aead-subkey"
+
+// deriveAEADSubkey 从当前 stream 的 key + salt 用 HKDF-SHA1 派生出 AEAD 子密钥。
+func deriveAEADSubkey(streamKey, salt []byte, info string, size int) ([]byte, error) {
+	reader := hkdf.New(sha1.New, streamKey, salt, []byte(info))
+	subkey := make([]byte, size)
+	if _, err := io.ReadFull(reader, subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// aeadFraming 包一个 AEAD 和它的递增 nonce，起始值是全 0xFF，每次 Seal/Open
+// 之后按小端方式自增（带进位），和 shadowaead 的 nonce 约定一致。
+type aeadFraming struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newAEADFraming(a cipher.AEAD) *aeadFraming {
+	nonce := make([]byte, a.NonceSize())
+	for i := range nonce {
+		nonce[i] = 0xFF
+	}
+	return &aeadFraming{aead: a, nonce: nonce}
+}
+
+func (f *aeadFraming) takeNonce() []byte {
+	nonce := append([]byte(nil), f.nonce...)
+	for i := range f.nonce {
+		f.nonce[i]++
+		if f.nonce[i] != 0 {
+			break
+		}
+	}
+	return nonce
+}
+
+func (f *aeadFraming) seal(dst, plaintext []byte) []byte {
+	return f.aead.Seal(dst, f.takeNonce(), plaintext, nil)
+}
+
+func (f *aeadFraming) open(dst, ciphertext []byte) ([]byte, error) {
+	return f.aead.Open(dst, f.takeNonce(), ciphertext, nil)
+}
+
+// writeAEADChunk 把 payload 按 maxAEADChunkSize 切块，每块以
+// Seal(size) || Seal(payload) 的形式写出。
+func writeAEADChunk(w io.Writer, framing *aeadFraming, payload []byte) (int, error) {
+	written := 0
+	for len(payload) > 0 {
+		chunk := payload
+		if len(chunk) > maxAEADChunkSize {
+			chunk = chunk[:maxAEADChunkSize]
+		}
+		sizeBytes := []byte{byte(len(chunk) >> 8), byte(len(chunk))}
+		if _, err := w.Write(framing.seal(nil, sizeBytes)); err != nil {
+			return written, err
+		}
+		if _, err := w.Write(framing.seal(nil, chunk)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		payload = payload[len(chunk):]
+	}
+	return written, nil
+}
+
+// readAEADChunk 读一个完整的 Seal(size) || Seal(payload) chunk 并返回解开的明文。
+func readAEADChunk(r io.Reader, framing *aeadFraming) ([]byte, error) {
+	overhead := framing.aead.Overhead()
+	sizeBuf := make([]byte, 2+overhead)
+	if _, err := io.ReadFull(r, sizeBuf); err != nil {
+		return nil, err
+	}
+	sizeBytes, err := framing.open(sizeBuf[:0], sizeBuf)
+	if err != nil {
+		return nil, fmt.Errorf("aead chunk: open size: %w", err)
+	}
+	size := int(sizeBytes[0])<<8 | int(sizeBytes[1])
+
+	payloadBuf := make([]byte, size+overhead)
+	if _, err := io.ReadFull(r, payloadBuf); err != nil {
+		return nil, err
+	}
+	payload, err := framing.open(payloadBuf[:0], payloadBuf)
+	if err != nil {
+		return nil, fmt.Errorf("aead chunk: open payload: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,52 @@
+package shadowstream
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+// csprngChunkSize 是每次从 crypto/rand 取出、暂存在池化 buffer 里的字节数，
+// 用来把"每次要若干随机字节都触发一次 syscall"摊薄成批量读取。
+const csprngChunkSize = 4096
+
+type csprngBuffer struct {
+	buf []byte
+	pos int
+}
+
+var csprngPool = sync.Pool{
+	New: func() any {
+		return &csprngBuffer{buf: make([]byte, csprngChunkSize), pos: csprngChunkSize}
+	},
+}
+
+// csprngRead 用池化的 crypto/rand buffer 填满 p，替代未播种、非并发安全的
+// math/rand。
+func csprngRead(p []byte) {
+	cb := csprngPool.Get().(*csprngBuffer)
+	defer csprngPool.Put(cb)
+	for len(p) > 0 {
+		if cb.pos >= len(cb.buf) {
+			if _, err := io.ReadFull(rand.Reader, cb.buf); err != nil {
+				// crypto/rand 读失败说明系统熵源不可用，没有办法安全地继续。
+				panic("shadowstream: crypto/rand unavailable: " + err.Error())
+			}
+			cb.pos = 0
+		}
+		n := copy(p, cb.buf[cb.pos:])
+		cb.pos += n
+		p = p[n:]
+	}
+}
+
+// csprngIntn 返回 [0, n) 之间的随机数，替代 math_rand.Intn。
+func csprngIntn(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	var b [4]byte
+	csprngRead(b[:])
+	v := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	return int(v % uint32(n))
+}
@@ -0,0 +1,18 @@
+package shadowstream
+
+import "testing"
+
+// BenchmarkRandomBytesGeneratorBurst 在一个 goroutine 里连续调用 1000 次
+// RandomBytesGenerator，相当于 1000 条连接各自取一次 padding，并报告每个 burst
+// 的分配次数。随机字节来自池化的 csprngPool buffer；每次调用仍会分配自己返回的
+// 切片，所以每个 burst 的分配次数和 burst 大小成正比。
+func BenchmarkRandomBytesGeneratorBurst(b *testing.B) {
+	const burstSize = 1000
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < burstSize; j++ {
+			_ = RandomBytesGenerator(0, defaultMaxPadding)
+		}
+	}
+}
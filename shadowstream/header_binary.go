@@ -0,0 +1,119 @@
+package shadowstream
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// headerMagic/headerVersion 标记二进制 header 的格式版本，方便以后升级格式时
+// 能在 readResponse 里直接拒绝不认识的版本，而不是当成乱码硬解析。
+const (
+	headerMagic   uint16 = 0x5353 // "SS"
+	headerVersion byte   = 1
+)
+
+// bodyMethodID/bodyMethodByID 把 body 的加密方式映射到 bodyMethodsList 里的下标，
+// 二进制 header 用这一个字节代替 JSON 里完整的方法名字符串。
+func bodyMethodID(name string) (byte, bool) {
+	for i, candidate := range bodyMethodsList {
+		if candidate == name {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+func bodyMethodByID(id byte) (string, bool) {
+	if int(id) >= len(bodyMethodsList) {
+		return "", false
+	}
+	return bodyMethodsList[id], true
+}
+
+// encodeBinaryHeader 编码成 magic(2)|version(1)|time(4)|method_id(1)|iv_len(1)|iv|
+// pw_len(1)|pw|pad_len(2)|pad，比 JSON 版本省掉字段名和十六进制展开的开销。
+func encodeBinaryHeader(bodyMethod string, t uint32, iv, password, padding []byte) ([]byte, error) {
+	methodID, ok := bodyMethodID(bodyMethod)
+	if !ok {
+		return nil, fmt.Errorf("binary header: unknown body method %q", bodyMethod)
+	}
+	if len(iv) > 0xFF {
+		return nil, fmt.Errorf("binary header: iv too long (%d)", len(iv))
+	}
+	if len(password) > 0xFF {
+		return nil, fmt.Errorf("binary header: password too long (%d)", len(password))
+	}
+	if len(padding) > 0xFFFF {
+		return nil, fmt.Errorf("binary header: padding too long (%d)", len(padding))
+	}
+
+	buf := make([]byte, 0, 2+1+4+1+1+len(iv)+1+len(password)+2+len(padding))
+	var u16 [2]byte
+	var u32 [4]byte
+	binary.BigEndian.PutUint16(u16[:], headerMagic)
+	buf = append(buf, u16[:]...)
+	buf = append(buf, headerVersion)
+	binary.BigEndian.PutUint32(u32[:], t)
+	buf = append(buf, u32[:]...)
+	buf = append(buf, methodID)
+	buf = append(buf, byte(len(iv)))
+	buf = append(buf, iv...)
+	buf = append(buf, byte(len(password)))
+	buf = append(buf, password...)
+	binary.BigEndian.PutUint16(u16[:], uint16(len(padding)))
+	buf = append(buf, u16[:]...)
+	buf = append(buf, padding...)
+	return buf, nil
+}
+
+// decodeBinaryHeader 是 encodeBinaryHeader 的反操作；每一步都先检查剩余长度，
+// 格式错误/截断的输入只会返回 error，不会越界读。
+func decodeBinaryHeader(data []byte) (bodyMethod string, t uint32, iv, password, padding []byte, err error) {
+	const fixedLen = 2 + 1 + 4 + 1 + 1 // magic+version+time+method_id+iv_len
+	if len(data) < fixedLen {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: too short (%d bytes)", len(data))
+	}
+	if binary.BigEndian.Uint16(data[0:2]) != headerMagic {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: bad magic")
+	}
+	if data[2] != headerVersion {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: unsupported version %d", data[2])
+	}
+	t = binary.BigEndian.Uint32(data[3:7])
+	bodyMethod, ok := bodyMethodByID(data[7])
+	if !ok {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: unknown method id %d", data[7])
+	}
+
+	offset := 8
+	ivLen := int(data[offset])
+	offset++
+	if offset+ivLen > len(data) {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: truncated iv")
+	}
+	iv = data[offset : offset+ivLen]
+	offset += ivLen
+
+	if offset+1 > len(data) {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: truncated password length")
+	}
+	pwLen := int(data[offset])
+	offset++
+	if offset+pwLen > len(data) {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: truncated password")
+	}
+	password = data[offset : offset+pwLen]
+	offset += pwLen
+
+	if offset+2 > len(data) {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: truncated padding length")
+	}
+	padLen := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	offset += 2
+	if offset+padLen > len(data) {
+		return "", 0, nil, nil, nil, fmt.Errorf("binary header: truncated padding")
+	}
+	padding = data[offset : offset+padLen]
+
+	return bodyMethod, t, iv, password, padding, nil
+}
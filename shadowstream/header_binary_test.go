@@ -0,0 +1,58 @@
+package shadowstream
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzDecodeBinaryHeader 检查 decodeBinaryHeader 在任意输入（包括截断/篡改的
+// header）下只会返回 error，不会 panic 或越界读。合法 header 能否原样解析回去
+// 由 TestEncodeDecodeBinaryHeaderRoundTrip 检查，这里不比对解析结果。
+func FuzzDecodeBinaryHeader(f *testing.F) {
+	seed, err := encodeBinaryHeader("aes-128-ctr", 1, []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8}, []byte{9, 9})
+	if err != nil {
+		f.Fatalf("encodeBinaryHeader seed: %v", err)
+	}
+	f.Add(seed)
+	f.Add([]byte{})
+	f.Add([]byte{0x53, 0x53, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeBinaryHeader(data)
+	})
+}
+
+// TestEncodeDecodeBinaryHeaderRoundTrip 验证 encodeBinaryHeader 产出的 header
+// 能被 decodeBinaryHeader 精确解析回原始字段。
+func TestEncodeDecodeBinaryHeaderRoundTrip(t *testing.T) {
+	wantMethod := "aes-128-ctr"
+	wantTime := uint32(1234567890)
+	wantIV := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	wantPassword := []byte{9, 8, 7, 6}
+	wantPadding := []byte{0xAA, 0xBB, 0xCC}
+
+	data, err := encodeBinaryHeader(wantMethod, wantTime, wantIV, wantPassword, wantPadding)
+	if err != nil {
+		t.Fatalf("encodeBinaryHeader: %v", err)
+	}
+
+	method, tm, iv, password, padding, err := decodeBinaryHeader(data)
+	if err != nil {
+		t.Fatalf("decodeBinaryHeader: %v", err)
+	}
+	if method != wantMethod {
+		t.Errorf("method mismatch: got %q, want %q", method, wantMethod)
+	}
+	if tm != wantTime {
+		t.Errorf("time mismatch: got %d, want %d", tm, wantTime)
+	}
+	if !bytes.Equal(iv, wantIV) {
+		t.Errorf("iv mismatch: got %x, want %x", iv, wantIV)
+	}
+	if !bytes.Equal(password, wantPassword) {
+		t.Errorf("password mismatch: got %x, want %x", password, wantPassword)
+	}
+	if !bytes.Equal(padding, wantPadding) {
+		t.Errorf("padding mismatch: got %x, want %x", padding, wantPadding)
+	}
+}
@@ -0,0 +1,99 @@
+package shadowstream
+
+import (
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// lengthHKDFInfo 是 length 层密钥派生时使用的 HKDF info，version 化以便将来替换算法。
+const lengthHKDFInfo = "ss-length-v1"
+
+// lengthKeyMaterial 保存通过 ECDH 协商出的 length 层密钥/IV，
+// 用来替换写死的 lengthPassword/lengthIV。
+type lengthKeyMaterial struct {
+	key []byte
+	iv  []byte
+}
+
+// deriveLengthKeyMaterial 用 HKDF(shared, "ss-length-v1") 派生出
+// aes-256-cfb 所需的 key 和 iv。
+func deriveLengthKeyMaterial(shared []byte) (*lengthKeyMaterial, error) {
+	reader := hkdf.New(sha256.New, shared, nil, []byte(lengthHKDFInfo))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(reader, iv); err != nil {
+		return nil, err
+	}
+	return &lengthKeyMaterial{key: key, iv: iv}, nil
+}
+
+// writePaddedPublicKey 把本端的 ECDH 公钥填充到 [len(pub), MAX_HEADER_AND_IV_SIZE)
+// 之间的随机长度后写出，这样握手包的大小分布和现有的 padded header 保持一致，
+// 不会成为额外的指纹特征。
+func writePaddedPublicKey(w io.Writer, pub []byte) error {
+	padding := RandomBytesGenerator(0, MAX_HEADER_AND_IV_SIZE-len(pub)-1)
+	packet := make([]byte, 1+len(pub)+len(padding))
+	packet[0] = uint8(len(pub) + len(padding))
+	copy(packet[1:], pub)
+	copy(packet[1+len(pub):], padding)
+	_, err := w.Write(packet)
+	return err
+}
+
+// readPaddedPublicKey 读回对端写的填充公钥包，丢弃填充部分。
+func readPaddedPublicKey(r io.Reader, pubLen int) ([]byte, error) {
+	var lengthBuf [1]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	total := int(lengthBuf[0])
+	if total < pubLen {
+		return nil, fmt.Errorf("length handshake: packet %d shorter than public key %d", total, pubLen)
+	}
+	packet := make([]byte, total)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	return packet[:pubLen], nil
+}
+
+// performLengthHandshake 做一次 curve25519 ECDH：写出本端的填充公钥，
+// 读回对端的填充公钥，再派生出 length 层的 key/iv。两端都是先发公钥，所以写和读
+// 并发进行，在没有缓冲的连接（比如 net.Pipe）上也不会互相等死。
+func performLengthHandshake(rw io.ReadWriter) (*lengthKeyMaterial, error) {
+	curve := ecdh.X25519()
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writePaddedPublicKey(rw, pub)
+	}()
+	peerPub, err := readPaddedPublicKey(rw, len(pub))
+	if err != nil {
+		return nil, err
+	}
+	if err := <-writeErr; err != nil {
+		return nil, err
+	}
+	peerKey, err := curve.NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	return deriveLengthKeyMaterial(shared)
+}
@@ -12,9 +12,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	math_rand "math/rand"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	C "github.com/DuweilongR/sing-shadowsocks2/cipher"
@@ -59,6 +59,22 @@ type Method struct {
 	methodName string
 	ctx        context.Context
 	option     C.MethodOptions
+
+	aeadConstructor AEADConstructor
+
+	// replayFilter 是这个 Method（也就是这一个 password/listener）专属的重放
+	// 检测窗口，在 NewMethod_L 里就建好，不和其它 Method 实例共享，这样不同
+	// listener/密码之间不会互相污染对方的 IV 记录。
+	replayFilter *replayFilter
+}
+
+// WithAEADFraming 返回一个启用了 AEAD chunk 分帧的 Method 副本：body 数据不再是裸
+// XOR，而是按 Seal(size)||Seal(payload) 分帧，子密钥从当前 stream key/salt 派生，
+// 读写两个方向各用各的 nonce 序列。不影响外层的 header/length 混淆。
+func (m *Method) WithAEADFraming(constructor AEADConstructor) *Method {
+	clone := *m
+	clone.aeadConstructor = constructor
+	return &clone
 }
 
 func ivGenerator(ivSize int) ([]byte, error) {
@@ -160,6 +176,7 @@ func NewMethod_L(ctx context.Context, methodName string, options C.MethodOptions
 	} else {
 		return nil, C.ErrMissingPassword
 	}
+	m.replayFilter = newReplayFilter(defaultReplayWindow)
 	return m, nil
 }
 
@@ -178,6 +195,10 @@ func blockStream(blockCreator func(key []byte) (cipher.Block, error), streamCrea
 }
 
 func (m *Method) DialConn(conn net.Conn, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := m.wrapSeedObfs(conn)
+	if err != nil {
+		return nil, err
+	}
 	ssConn := &clientConn{
 		ExtendedConn: bufio.NewExtendedConn(conn),
 		method:       m,
@@ -187,6 +208,14 @@ func (m *Method) DialConn(conn net.Conn, destination M.Socksaddr) (net.Conn, err
 }
 
 func (m *Method) DialEarlyConn(conn net.Conn, destination M.Socksaddr) net.Conn {
+	//DialEarlyConn 没有 error 返回值可用，和 DialConn 一样在这里先跑一遍
+	//seed-obfs 握手；万一配了 obfs 插件但握手失败，就照原样用没包过的 conn
+	//继续（失败的影响会在真正的 ss 握手阶段体现出来），而不是返回 nil conn。
+	if wrapped, err := m.wrapSeedObfs(conn); err != nil {
+		log.Errorln("DialEarlyConn wrapSeedObfs fail : %s", err.Error())
+	} else {
+		conn = wrapped
+	}
 	return &clientConn{
 		ExtendedConn: bufio.NewExtendedConn(conn),
 		method:       m,
@@ -223,6 +252,14 @@ var (
 		//'camellia-128-cfb','camellia-192-cfb','camellia-256-cfb',
 		//'rc4','rc4-md5','rc4-md5-6'
 	}
+
+	// lengthEncryptConstructor/lengthDecryptConstructor 和 legacyLengthKey 在
+	// 包初始化时算好一次：lengthMethod/lengthPassword 都是常量，WriteHeader/
+	// readResponse 不再需要每次都跑一遍 NewMethod_L 的 switch 和 legacykey.Key
+	// 派生来重新拿到同样的东西。
+	lengthEncryptConstructor = blockStream(aes.NewCipher, cipher.NewCFBEncrypter)
+	lengthDecryptConstructor = blockStream(aes.NewCipher, cipher.NewCFBDecrypter)
+	legacyLengthKey          = legacykey.Key([]byte(lengthPassword), 32)
 )
 
 type message struct {
@@ -235,11 +272,14 @@ type message struct {
 
 func RandomBytesGenerator(min, max int) []byte {
 	const template = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
-	length := min + math_rand.Intn(max+1-min) - 1 //[0, n)
+	length := min + csprngIntn(max+1-min) - 1 //[0, n)
+	if length < 0 {
+		length = 0
+	}
 
 	ret := make([]byte, length)
 	for i := 0; i < length; i++ {
-		ret[i] = template[math_rand.Intn(len(template))]
+		ret[i] = template[csprngIntn(len(template))]
 	}
 	return ret
 }
@@ -271,17 +311,58 @@ type clientConn struct {
 	readStream  cipher.Stream
 	writeStream cipher.Stream
 	buf         [MAX_HEADER_AND_IV_SIZE]byte
+	lengthKey   *lengthKeyMaterial
+	// lengthKeyOnce/lengthKeyErr 保证 Read 和 Write 并发触发握手时
+	// performLengthHandshake 只真正跑一次，另一侧等在 Do 里拿到同一个结果。
+	lengthKeyOnce sync.Once
+	lengthKeyErr  error
+
+	readFraming  *aeadFraming
+	writeFraming *aeadFraming
+	readLeftover []byte
+
+	// isServer 标记这个 clientConn 是 Method.NewConn 接出来的服务端连接：
+	// 服务端的第一次 Write 直接就是要回给客户端的业务数据，不像
+	// DialConn/DialEarlyConn 那样需要在最前面插入一段 destination socksaddr
+	// （那段地址是客户端告诉服务端"连去哪"用的，服务端的响应流里没有它）。
+	isServer bool
+
+	// validateMessage 在服务端用来做重放检测；客户端场景下留空，行为不变。
+	validateMessage func(message) error
+}
+
+// ensureLengthKeyMaterial 在非 LegacyLengthObfs 模式下协商一次 length 层的
+// key/iv，协商结果缓存在连接上，读写两侧共用同一份。DialEarlyConn/NewConn
+// 场景下第一次真正的 Read 和第一次真正的 Write 可能并发发生，sync.Once
+// 保证两边只有一个去跑 performLengthHandshake，另一个等待同一个结果。
+func (c *clientConn) ensureLengthKeyMaterial() error {
+	if c.method.option.LegacyLengthObfs {
+		return nil
+	}
+	c.lengthKeyOnce.Do(func() {
+		c.lengthKey, c.lengthKeyErr = performLengthHandshake(c.ExtendedConn)
+	})
+	return c.lengthKeyErr
 }
 
 func (c *clientConn) readResponse() error {
+	if err := c.ensureLengthKeyMaterial(); err != nil {
+		log.Errorln("readResponse ensureLengthKeyMaterial fail : %s", err.Error())
+		return err
+	}
 	//length 读取header+iv长度
-	c.method.option.Key = nil
-	c.method.option.Password = lengthPassword
-	methodLength, err := NewMethod_L(c.method.ctx, lengthMethod, c.method.option)
+	effectiveLengthKey := legacyLengthKey
+	effectiveLengthIV := lengthIV
+	if c.lengthKey != nil {
+		effectiveLengthKey = c.lengthKey.key
+		effectiveLengthIV = c.lengthKey.iv
+	}
+	var err error
+	c.readStream, err = lengthDecryptConstructor(effectiveLengthKey, effectiveLengthIV)
 	if err != nil {
-		log.Errorln("readResponse methodLength NewMethod_L fail : %s", err.Error())
+		log.Errorln("readResponse lengthDecryptConstructor fail : %s", err.Error())
+		return err
 	}
-	c.readStream, err = methodLength.decryptConstructor(methodLength.key, lengthIV)
 	if _, err := io.ReadFull(c.ExtendedConn, c.buf[:1]); err != nil {
 		log.Errorln("readResponse length error : %s", err.Error())
 		return err
@@ -306,53 +387,83 @@ func (c *clientConn) readResponse() error {
 	//分别获取header 和 iv
 	header := c.buf[0 : length-uint8(ivSize)]
 	iv := c.buf[length-uint8(ivSize) : length]
-	//设置 header的编解码参数
-	c.method.option.Key = nil
-	c.method.option.Password = c.method.password
-	headerMethod, err := NewMethod_L(c.method.ctx, c.method.methodName, c.method.option)
-	if err != nil {
-		log.Errorln("readResponse headerMethod NewMethod_L fail : %s", err.Error())
-	}
-	c.readStream, err = headerMethod.decryptConstructor(headerMethod.key, iv)
+	//header 复用 c.method 自己的密钥和构造器，methodName/password 和外层完全一样，
+	//不需要再 NewMethod_L 出一份一模一样的 Method
+	c.readStream, err = c.method.decryptConstructor(c.method.key, iv)
 	if err != nil {
 		log.Errorln("readResponse headerMethod.decryptConstructor fail : %s", err.Error())
+		return err
 	}
 	//获取头解析器
 	c.readStream.XORKeyStream(header, header)
-	//message
+	//message：默认按二进制 TLV 解析，HeaderFormat == "json" 时走旧的 JSON 解析
 	//log.Debugln("readResponse Receive : %d, %v, %v", length, header, iv)
-	var msg message
-	err = json.Unmarshal(header, &msg)
-	if err != nil {
-		log.Errorln("readResponse json.Unmarshal fail : %s", err.Error())
-		return err
+	var bodyMethodName string
+	var msgTime uint32
+	var bodyIV, bodyPassword []byte
+	if c.method.option.HeaderFormat == "json" {
+		var msg message
+		if err := json.Unmarshal(header, &msg); err != nil {
+			log.Errorln("readResponse json.Unmarshal fail : %s", err.Error())
+			return err
+		}
+		bodyMethodName = msg.Method
+		msgTime = msg.Time
+		bodyIV, err = hex.DecodeString(msg.IV)
+		if err != nil {
+			log.Errorln("readResponse hex DecodeString IV fail : %s", err.Error())
+			return err
+		}
+		bodyPassword, err = hex.DecodeString(msg.Password)
+		if err != nil {
+			log.Errorln("readResponse hex DecodeString Password fail : %s", err.Error())
+			return err
+		}
+	} else {
+		bodyMethodName, msgTime, bodyIV, bodyPassword, _, err = decodeBinaryHeader(header)
+		if err != nil {
+			log.Errorln("readResponse decodeBinaryHeader fail : %s", err.Error())
+			return err
+		}
 	}
-	//log.Debugln("readResponse msg : %v", msg)
 
-	//body
-	iv, err = hex.DecodeString(msg.IV)
-	if err != nil {
-		log.Errorln("readResponse hex DecodeString IV fail : %s", err.Error())
-		return err
-	}
-	password, err := hex.DecodeString(msg.Password)
-	if err != nil {
-		log.Errorln("readResponse hex DecodeString Password fail : %s", err.Error())
-		return err
+	if c.validateMessage != nil {
+		if err := c.validateMessage(message{Time: msgTime, IV: hex.EncodeToString(bodyIV)}); err != nil {
+			log.Errorln("readResponse validateMessage fail : %s", err.Error())
+			return err
+		}
 	}
-	//设置 body 的编解码参数
-	c.method.option.Key = nil
-	c.method.option.Password = string(password)
-	methodBody, err := NewMethod_L(c.method.ctx, msg.Method, c.method.option)
+
+	//设置 body 的编解码参数：在 c.method.option 的副本上改，不要直接改
+	//c.method.option 本身 —— 同一个 *Method 会被很多条并发连接共用，直接改
+	//共享字段会被其它连接的握手互相踩掉。
+	bodyOption := c.method.option
+	bodyOption.Key = nil
+	bodyOption.Password = string(bodyPassword)
+	methodBody, err := NewMethod_L(c.method.ctx, bodyMethodName, bodyOption)
 	if err != nil {
 		log.Errorln("readResponse methodBody.NewMethod_L fail : %s", err.Error())
 	}
 	//获取body解析器
-	c.readStream, err = methodBody.decryptConstructor(methodBody.key, iv)
+	c.readStream, err = methodBody.decryptConstructor(methodBody.key, bodyIV)
 	if err != nil {
 		log.Errorln("readResponse methodBody.decryptConstructor fail : %s", err.Error())
+		return err
+	}
+	if c.method.aeadConstructor != nil {
+		subkey, err := deriveAEADSubkey(methodBody.key, bodyIV, aeadSubkeyInfo, methodBody.keyLength)
+		if err != nil {
+			log.Errorln("readResponse deriveAEADSubkey fail : %s", err.Error())
+			return err
+		}
+		aead, err := c.method.aeadConstructor(subkey)
+		if err != nil {
+			log.Errorln("readResponse aeadConstructor fail : %s", err.Error())
+			return err
+		}
+		c.readFraming = newAEADFraming(aead)
 	}
-	return err
+	return nil
 }
 
 func (c *clientConn) Read(p []byte) (n int, err error) {
@@ -362,6 +473,9 @@ func (c *clientConn) Read(p []byte) (n int, err error) {
 			return
 		}
 	}
+	if c.readFraming != nil {
+		return c.readFramed(p)
+	}
 	n, err = c.ExtendedConn.Read(p)
 	if err != nil {
 		return
@@ -370,14 +484,31 @@ func (c *clientConn) Read(p []byte) (n int, err error) {
 	return
 }
 
+// readFramed 从 c.readLeftover 里先消费上一个 chunk 剩下的数据，消费完了再读一个
+// 新的 AEAD chunk。
+func (c *clientConn) readFramed(p []byte) (int, error) {
+	if len(c.readLeftover) == 0 {
+		payload, err := readAEADChunk(c.ExtendedConn, c.readFraming)
+		if err != nil {
+			return 0, err
+		}
+		c.readLeftover = payload
+	}
+	n := copy(p, c.readLeftover)
+	c.readLeftover = c.readLeftover[n:]
+	return n, nil
+}
+
 func (c *clientConn) WriteHeader() error {
 	//body 的加密方式及加密密钥
-	bodyMethod := bodyMethodsList[math_rand.Intn(len(bodyMethodsList))]
+	bodyMethod := bodyMethodsList[csprngIntn(len(bodyMethodsList))]
 	bodyPassword := RandomStringGenerator(8, 16)
-	//设置body的编解码参数
-	c.method.option.Key = nil
-	c.method.option.Password = bodyPassword
-	bodyMethodS, err := NewMethod_L(c.method.ctx, bodyMethod, c.method.option)
+	//设置body的编解码参数：同 readResponse，在副本上改，不要直接改
+	//c.method.option —— 并发连接共用同一个 *Method。
+	bodyOption := c.method.option
+	bodyOption.Key = nil
+	bodyOption.Password = bodyPassword
+	bodyMethodS, err := NewMethod_L(c.method.ctx, bodyMethod, bodyOption)
 	if err != nil {
 		log.Errorln("WriteHeader bodyMethodS.NewMethod_L fail : %s", err.Error())
 	}
@@ -386,29 +517,32 @@ func (c *clientConn) WriteHeader() error {
 		log.Errorln("WriteHeader bodyIV.ivGenerator fail : %s", err.Error())
 	}
 
-	//message  组装header
-	var msg message
-	msg.Time = uint32(time.Now().Unix())
-	msg.IV = hex.EncodeToString(bodyIV)
-	msg.Method = bodyMethod
-	msg.Password = hex.EncodeToString([]byte(bodyPassword))
-	msg.Padding = hex.EncodeToString([]byte(RandomStringGenerator(10, 30)))
-	//LogDbg("%v",msg)
-
-	//log.Debugln("WriteHeader msg : %v", msg)
-	header, err := json.Marshal(&msg)
-	if err != nil {
-		log.Errorln("WriteHeader json.Marshal fail : %s", err.Error())
-		return err
+	//组装header：默认走紧凑的二进制 TLV，MethodOptions.HeaderFormat == "json" 时
+	//保留旧的 JSON 格式作为兼容
+	msgTime := uint32(time.Now().Unix())
+	padding := RandomBytesGenerator(10, 30)
+	var header []byte
+	if c.method.option.HeaderFormat == "json" {
+		var msg message
+		msg.Time = msgTime
+		msg.IV = hex.EncodeToString(bodyIV)
+		msg.Method = bodyMethod
+		msg.Password = hex.EncodeToString([]byte(bodyPassword))
+		msg.Padding = hex.EncodeToString(padding)
+		header, err = json.Marshal(&msg)
+		if err != nil {
+			log.Errorln("WriteHeader json.Marshal fail : %s", err.Error())
+			return err
+		}
+	} else {
+		header, err = encodeBinaryHeader(bodyMethod, msgTime, bodyIV, []byte(bodyPassword), padding)
+		if err != nil {
+			log.Errorln("WriteHeader encodeBinaryHeader fail : %s", err.Error())
+			return err
+		}
 	}
 
-	//header 设置head的编解码器
-	c.method.option.Key = nil
-	c.method.option.Password = c.method.password
-	headMethodS, err := NewMethod_L(c.method.ctx, c.method.methodName, c.method.option)
-	if err != nil {
-		log.Errorln("WriteHeader headMethodS.NewMethod_L fail : %s", err.Error())
-	}
+	//header 复用 c.method 自己的密钥和构造器，不需要再 NewMethod_L 出一份
 	headerIV, err := ivGenerator(c.method.saltLength)
 	if err != nil {
 		log.Errorln("WriteHeader headerIV.ivGenerator fail : %s", err.Error())
@@ -420,15 +554,20 @@ func (c *clientConn) WriteHeader() error {
 	}
 
 	//length 设置编码器
-	c.method.option.Key = nil
-	c.method.option.Password = lengthPassword
-	lenMethodS, err := NewMethod_L(c.method.ctx, lengthMethod, c.method.option)
-	if err != nil {
-		log.Errorln("WriteHeader lenMethodS.NewMethod_L fail : %s", err.Error())
+	if err := c.ensureLengthKeyMaterial(); err != nil {
+		log.Errorln("WriteHeader ensureLengthKeyMaterial fail : %s", err.Error())
+		return err
+	}
+	effectiveLengthKey := legacyLengthKey
+	effectiveLengthIV := lengthIV
+	if c.lengthKey != nil {
+		effectiveLengthKey = c.lengthKey.key
+		effectiveLengthIV = c.lengthKey.iv
 	}
-	c.writeStream, err = lenMethodS.encryptConstructor(lenMethodS.key, lengthIV)
+	c.writeStream, err = lengthEncryptConstructor(effectiveLengthKey, effectiveLengthIV)
 	if err != nil {
-		log.Errorln("WriteHeader lenMethodS.encryptConstructor fail : %s", err.Error())
+		log.Errorln("WriteHeader lengthEncryptConstructor fail : %s", err.Error())
+		return err
 	}
 	//write to  写第一位head + iv长度
 	c.buf[0] = uint8(length)
@@ -437,9 +576,9 @@ func (c *clientConn) WriteHeader() error {
 	c.ExtendedConn.Write(c.buf[:1])
 
 	//获取 head解释器
-	c.writeStream, err = headMethodS.encryptConstructor(headMethodS.key, headerIV)
+	c.writeStream, err = c.method.encryptConstructor(c.method.key, headerIV)
 	if err != nil {
-		log.Errorln("WriteHeader headMethodS.encryptConstructor fail : %s", err.Error())
+		log.Errorln("WriteHeader headerEncryptConstructor fail : %s", err.Error())
 	}
 	c.writeStream.XORKeyStream(header, header)
 	//log.Debugln("Write header XOR : %v", header)
@@ -452,6 +591,20 @@ func (c *clientConn) WriteHeader() error {
 	c.writeStream, err = bodyMethodS.encryptConstructor(bodyMethodS.key, bodyIV)
 	if err != nil {
 		log.Errorln("WriteHeader bodyMethodS.encryptConstructor fail : %s", err.Error())
+		return err
+	}
+	if c.method.aeadConstructor != nil {
+		subkey, err := deriveAEADSubkey(bodyMethodS.key, bodyIV, aeadSubkeyInfo, bodyMethodS.keyLength)
+		if err != nil {
+			log.Errorln("WriteHeader deriveAEADSubkey fail : %s", err.Error())
+			return err
+		}
+		aead, err := c.method.aeadConstructor(subkey)
+		if err != nil {
+			log.Errorln("WriteHeader aeadConstructor fail : %s", err.Error())
+			return err
+		}
+		c.writeFraming = newAEADFraming(aead)
 	}
 	return nil
 }
@@ -459,14 +612,25 @@ func (c *clientConn) WriteHeader() error {
 func (c *clientConn) Write(p []byte) (n int, err error) {
 	if c.writeStream == nil {
 		c.WriteHeader()
-		addrLen := M.SocksaddrSerializer.AddrPortLen(c.destination)
-		buffer := buf.NewSize(addrLen)
-		err = M.SocksaddrSerializer.WriteAddrPort(buffer, c.destination)
-		if err != nil {
-			return
+		if !c.isServer {
+			addrLen := M.SocksaddrSerializer.AddrPortLen(c.destination)
+			buffer := buf.NewSize(addrLen)
+			err = M.SocksaddrSerializer.WriteAddrPort(buffer, c.destination)
+			if err != nil {
+				return
+			}
+			if c.writeFraming != nil {
+				if _, err = writeAEADChunk(c.ExtendedConn, c.writeFraming, buffer.Bytes()); err != nil {
+					return
+				}
+			} else {
+				c.writeStream.XORKeyStream(buffer.To(addrLen), buffer.To(addrLen))
+				c.ExtendedConn.Write(buffer.Bytes())
+			}
 		}
-		c.writeStream.XORKeyStream(buffer.To(addrLen), buffer.To(addrLen))
-		c.ExtendedConn.Write(buffer.Bytes())
+	}
+	if c.writeFraming != nil {
+		return writeAEADChunk(c.ExtendedConn, c.writeFraming, p)
 	}
 	c.writeStream.XORKeyStream(p, p)
 	return c.ExtendedConn.Write(p)
@@ -480,6 +644,15 @@ func (c *clientConn) ReadBuffer(buffer *buf.Buffer) error {
 		}
 	}
 
+	if c.readFraming != nil {
+		n, err := c.readFramed(buffer.FreeBytes())
+		if err != nil {
+			return err
+		}
+		buffer.Truncate(n)
+		return nil
+	}
+
 	err := c.ExtendedConn.ReadBuffer(buffer)
 	if err != nil {
 		return err
@@ -491,14 +664,26 @@ func (c *clientConn) ReadBuffer(buffer *buf.Buffer) error {
 func (c *clientConn) WriteBuffer(buffer *buf.Buffer) error {
 	if c.writeStream == nil {
 		c.WriteHeader()
-		addrLen := M.SocksaddrSerializer.AddrPortLen(c.destination)
-		buffer := buf.NewSize(addrLen)
-		err := M.SocksaddrSerializer.WriteAddrPort(buffer, c.destination)
-		if err != nil {
-			return err
+		if !c.isServer {
+			addrLen := M.SocksaddrSerializer.AddrPortLen(c.destination)
+			addrBuffer := buf.NewSize(addrLen)
+			err := M.SocksaddrSerializer.WriteAddrPort(addrBuffer, c.destination)
+			if err != nil {
+				return err
+			}
+			if c.writeFraming != nil {
+				if _, err := writeAEADChunk(c.ExtendedConn, c.writeFraming, addrBuffer.Bytes()); err != nil {
+					return err
+				}
+			} else {
+				c.writeStream.XORKeyStream(addrBuffer.To(addrLen), addrBuffer.To(addrLen))
+				c.ExtendedConn.Write(addrBuffer.Bytes())
+			}
 		}
-		c.writeStream.XORKeyStream(buffer.To(addrLen), buffer.To(addrLen))
-		c.ExtendedConn.Write(buffer.Bytes())
+	}
+	if c.writeFraming != nil {
+		_, err := writeAEADChunk(c.ExtendedConn, c.writeFraming, buffer.Bytes())
+		return err
 	}
 	c.writeStream.XORKeyStream(buffer.Bytes(), buffer.Bytes())
 	return c.ExtendedConn.WriteBuffer(buffer)
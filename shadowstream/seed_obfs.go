@@ -0,0 +1,213 @@
+package shadowstream
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rc4"
+	"crypto/sha1"
+	"io"
+	"net"
+	"strconv"
+
+	C "github.com/DuweilongR/sing-shadowsocks2/cipher"
+)
+
+// ObfsList 是预握手混淆器的名字表，和 MethodList 并列注册。DialConn/NewConn
+// 只看 MethodOptions.PluginOpts["keyword"]：配了 keyword 就启用 seed-rc4，
+// 不读 PluginOpts["obfs"]。
+var ObfsList = []string{
+	"seed-rc4",
+}
+
+func init() {
+	C.RegisterPlugin(ObfsList, NewSeedObfsConn)
+}
+
+const (
+	seedSize            = 16
+	defaultMaxPadding   = 64
+	seedDirectionClient = "client-to-server-iv"
+	seedDirectionServer = "server-to-client-iv"
+)
+
+// deriveSeedKey 用 HMAC(keyword, seed||direction) 截断出 RC4 key，
+// 方向字符串让两端派生出镜像但不同的 key。
+func deriveSeedKey(keyword string, seed []byte, direction string) []byte {
+	mac := hmac.New(sha1.New, []byte(keyword))
+	mac.Write(seed)
+	mac.Write([]byte(direction))
+	return mac.Sum(nil)[:16]
+}
+
+// writeSeedMessage 发送 16 字节种子，再用派生出的 RC4 key 加密一段
+// [1 字节长度][随机填充] 之后写出。
+func writeSeedMessage(w io.Writer, seed, rc4Key, padding []byte) error {
+	if _, err := w.Write(seed); err != nil {
+		return err
+	}
+	stream, err := rc4.NewCipher(rc4Key)
+	if err != nil {
+		return err
+	}
+	packet := make([]byte, 1+len(padding))
+	packet[0] = uint8(len(padding))
+	copy(packet[1:], padding)
+	stream.XORKeyStream(packet, packet)
+	_, err = w.Write(packet)
+	return err
+}
+
+// readSeedMessage 读回对端的种子 + 填充，返回种子（丢弃填充部分）。
+func readSeedMessage(r io.Reader, keyword, direction string) ([]byte, error) {
+	seed := make([]byte, seedSize)
+	if _, err := io.ReadFull(r, seed); err != nil {
+		return nil, err
+	}
+	rc4Key := deriveSeedKey(keyword, seed, direction)
+	stream, err := rc4.NewCipher(rc4Key)
+	if err != nil {
+		return nil, err
+	}
+	var lengthByte [1]byte
+	if _, err := io.ReadFull(r, lengthByte[:]); err != nil {
+		return nil, err
+	}
+	stream.XORKeyStream(lengthByte[:], lengthByte[:])
+	padding := make([]byte, lengthByte[0])
+	if _, err := io.ReadFull(r, padding); err != nil {
+		return nil, err
+	}
+	stream.XORKeyStream(padding, padding)
+	return seed, nil
+}
+
+// seedObfsConn 在种子握手完成之后，把剩下的连接包进一对长期运行的 RC4
+// StreamReader/Writer 里，这样上层 length/header 的固定前缀就被进一步打散了。
+type seedObfsConn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+}
+
+func (c *seedObfsConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *seedObfsConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// NewSeedObfsConn 在底层 net.Conn 上做一次 obfs2/obfs4 风格的种子消息交换，
+// 然后返回一个包了长期 RC4 keystream 的 net.Conn，供 DialConn/DialEarlyConn
+// 进一步使用。keyword 和 maxPadding 来自 MethodOptions.PluginOpts 的
+// "keyword"/"max_padding"。
+func NewSeedObfsConn(conn net.Conn, keyword string, maxPadding int) (net.Conn, error) {
+	if maxPadding <= 0 {
+		maxPadding = defaultMaxPadding
+	}
+
+	seed, err := ivGenerator(seedSize)
+	if err != nil {
+		return nil, err
+	}
+	sendKey := deriveSeedKey(keyword, seed, seedDirectionClient)
+	padding := RandomBytesGenerator(0, maxPadding)
+	if err := writeSeedMessage(conn, seed, sendKey, padding); err != nil {
+		return nil, err
+	}
+	peerSeed, err := readSeedMessage(conn, keyword, seedDirectionServer)
+	if err != nil {
+		return nil, err
+	}
+
+	// 种子消息本身已经各自用了一次性的 RC4 key；从这里开始，剩余的连接数据
+	// 用同一对 key 派生出的长期 keystream 接力，而不是每个包都重新握手。
+	sendStream, err := rc4.NewCipher(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvKey := deriveSeedKey(keyword, peerSeed, seedDirectionServer)
+	recvStream, err := rc4.NewCipher(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seedObfsConn{
+		Conn:   conn,
+		reader: &cipher.StreamReader{S: recvStream, R: conn},
+		writer: &cipher.StreamWriter{S: sendStream, W: conn},
+	}, nil
+}
+
+// NewSeedObfsServerConn 是 NewSeedObfsConn 的服务端镜像：先读客户端的种子消息，
+// 再回写自己的种子消息，读写顺序和 NewSeedObfsConn 正好相反，但派生出的两把
+// RC4 key 和客户端各自算出来的完全一致（seedDirectionClient/seedDirectionServer
+// 分别标记了两个方向，谁先读谁先写不影响派生结果）。
+func NewSeedObfsServerConn(conn net.Conn, keyword string, maxPadding int) (net.Conn, error) {
+	if maxPadding <= 0 {
+		maxPadding = defaultMaxPadding
+	}
+
+	peerSeed, err := readSeedMessage(conn, keyword, seedDirectionClient)
+	if err != nil {
+		return nil, err
+	}
+	recvKey := deriveSeedKey(keyword, peerSeed, seedDirectionClient)
+
+	seed, err := ivGenerator(seedSize)
+	if err != nil {
+		return nil, err
+	}
+	sendKey := deriveSeedKey(keyword, seed, seedDirectionServer)
+	padding := RandomBytesGenerator(0, maxPadding)
+	if err := writeSeedMessage(conn, seed, sendKey, padding); err != nil {
+		return nil, err
+	}
+
+	sendStream, err := rc4.NewCipher(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvStream, err := rc4.NewCipher(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seedObfsConn{
+		Conn:   conn,
+		reader: &cipher.StreamReader{S: recvStream, R: conn},
+		writer: &cipher.StreamWriter{S: sendStream, W: conn},
+	}, nil
+}
+
+// wrapSeedObfs 如果 MethodOptions.PluginOpts 里配了 "keyword"，就在真正的 ss
+// 握手之前先跑一遍种子消息交换；没配就原样返回 conn。
+func (m *Method) wrapSeedObfs(conn net.Conn) (net.Conn, error) {
+	keyword := m.option.PluginOpts["keyword"]
+	if keyword == "" {
+		return conn, nil
+	}
+	maxPadding := defaultMaxPadding
+	if raw, ok := m.option.PluginOpts["max_padding"]; ok {
+		if parsed, err := strconv.Atoi(raw); err == nil {
+			maxPadding = parsed
+		}
+	}
+	return NewSeedObfsConn(conn, keyword, maxPadding)
+}
+
+// unwrapSeedObfs 是 wrapSeedObfs 的服务端镜像，供 Method.NewConn 在真正的 ss
+// 握手之前先跑一遍种子消息交换；没配 "keyword" 就原样返回 conn。
+func (m *Method) unwrapSeedObfs(conn net.Conn) (net.Conn, error) {
+	keyword := m.option.PluginOpts["keyword"]
+	if keyword == "" {
+		return conn, nil
+	}
+	maxPadding := defaultMaxPadding
+	if raw, ok := m.option.PluginOpts["max_padding"]; ok {
+		if parsed, err := strconv.Atoi(raw); err == nil {
+			maxPadding = parsed
+		}
+	}
+	return NewSeedObfsServerConn(conn, keyword, maxPadding)
+}
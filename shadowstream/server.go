@@ -0,0 +1,112 @@
+package shadowstream
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// defaultReplayWindow 是服务端接受的 message.Time 和本地时间之间允许的最大偏差，
+// 超出这个范围的握手会被当作重放/过期直接拒绝。
+const defaultReplayWindow = 60 * time.Second
+
+// replayFilter 是一个按时间窗口轮换的两代 IV 集合，效果上等价于一个会过期的
+// bloom filter：当前窗口的 IV 放在 current 里，上一个窗口的放在 previous 里，
+// 查重时两代都查，这样不用无限增长的内存就能覆盖 defaultReplayWindow 的回看范围。
+type replayFilter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	current  map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+}
+
+func newReplayFilter(window time.Duration) *replayFilter {
+	return &replayFilter{
+		window:  window,
+		current: make(map[string]struct{}),
+		rotated: time.Now(),
+	}
+}
+
+// seenOrAdd 在 iv 已经出现过时返回 true，否则记录下来并返回 false。
+func (f *replayFilter) seenOrAdd(iv string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.rotated) > f.window {
+		f.previous = f.current
+		f.current = make(map[string]struct{})
+		f.rotated = time.Now()
+	}
+	if _, ok := f.current[iv]; ok {
+		return true
+	}
+	if _, ok := f.previous[iv]; ok {
+		return true
+	}
+	f.current[iv] = struct{}{}
+	return false
+}
+
+// checkReplay 校验 message.Time 是否落在 defaultReplayWindow 之内，并确认这个
+// IV 没有在 filter 锁定的窗口内出现过。filter 来自调用方 Method 自己的
+// replayFilter，不同 Method（不同 password/listener）各用各的，互不干扰。
+func checkReplay(filter *replayFilter, msg message) error {
+	skew := time.Since(time.Unix(int64(msg.Time), 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > defaultReplayWindow {
+		return fmt.Errorf("shadowstream: message time skew %s exceeds replay window %s", skew, defaultReplayWindow)
+	}
+	if filter.seenOrAdd(msg.IV) {
+		return fmt.Errorf("shadowstream: iv %s already seen, possible replay", msg.IV)
+	}
+	return nil
+}
+
+// NewConn 是 DialConn 的镜像：先用 unwrapSeedObfs 跑一遍种子消息交换（如果
+// 客户端那边启用了 obfs 插件），再解析来自客户端的 length+header，在
+// readResponse 里对 message.Time/IV 做重放检测，然后把客户端用 body cipher
+// 写的目的地址解出来一起返回。返回的 net.Conn 后续的 Read/Write 复用
+// clientConn 已有的逻辑 —— 这一层协议本身就是双向对称的，服务端回写响应头
+// 走的也是同一份 WriteHeader。
+func (m *Method) NewConn(conn net.Conn) (net.Conn, M.Socksaddr, error) {
+	conn, err := m.unwrapSeedObfs(conn)
+	if err != nil {
+		return nil, M.Socksaddr{}, err
+	}
+	sc := &clientConn{
+		ExtendedConn: bufio.NewExtendedConn(conn),
+		method:       m,
+		isServer:     true,
+		validateMessage: func(msg message) error {
+			return checkReplay(m.replayFilter, msg)
+		},
+	}
+	if err := sc.readResponse(); err != nil {
+		return nil, M.Socksaddr{}, err
+	}
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(sc)
+	if err != nil {
+		return nil, M.Socksaddr{}, err
+	}
+	destination = destination.Unwrap()
+	sc.destination = destination
+	return sc, destination, nil
+}
+
+// NewPacketConn 是 DialPacketConn 的服务端版本。UDP 场景下 salt+ciphertext
+// 的编解码本身就是对称的（双方都只用 method.key），所以和客户端完全一样，
+// 只是换一个名字，方便调用方表达"这是listener侧"的意图。
+func (m *Method) NewPacketConn(conn net.Conn) N.NetPacketConn {
+	return &clientPacketConn{
+		ExtendedConn: bufio.NewExtendedConn(conn),
+		method:       m,
+	}
+}
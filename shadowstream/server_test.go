@@ -0,0 +1,79 @@
+package shadowstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	C "github.com/DuweilongR/sing-shadowsocks2/cipher"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// TestNewConnRoundTrip 用 net.Pipe 模拟一条物理连接，客户端走 DialConn，
+// 服务端走 Method.NewConn，验证服务端能解出和客户端一致的 destination，
+// 客户端写下去的 payload 能被服务端原样读回，并且服务端写回去的响应数据
+// 不会被错误地splice上一段 destination socksaddr —— 服务端的第一次 Write
+// 应该是纯粹的业务数据，客户端原样读回。
+func TestNewConnRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	options := C.MethodOptions{Key: key}
+
+	clientMethod, err := NewMethod_L(context.Background(), "aes-128-ctr", options)
+	if err != nil {
+		t.Fatalf("NewMethod_L client: %v", err)
+	}
+	serverMethod, err := NewMethod_L(context.Background(), "aes-128-ctr", options)
+	if err != nil {
+		t.Fatalf("NewMethod_L server: %v", err)
+	}
+
+	clientRaw, serverRaw := net.Pipe()
+	destination := M.ParseSocksaddrHostPort("example.com", 443)
+	request := []byte("hello shadowstream")
+	response := []byte("hello back from upstream")
+
+	serverResult := make(chan error, 1)
+	var gotDestination M.Socksaddr
+	receivedRequest := make([]byte, len(request))
+	go func() {
+		serverConn, dest, err := serverMethod.NewConn(serverRaw)
+		if err != nil {
+			serverResult <- err
+			return
+		}
+		gotDestination = dest
+		if _, err := io.ReadFull(serverConn, receivedRequest); err != nil {
+			serverResult <- err
+			return
+		}
+		_, err = serverConn.Write(response)
+		serverResult <- err
+	}()
+
+	clientConn, err := clientMethod.DialConn(clientRaw, destination)
+	if err != nil {
+		t.Fatalf("DialConn: %v", err)
+	}
+	if _, err := clientConn.Write(request); err != nil {
+		t.Fatalf("client Write: %v", err)
+	}
+	receivedResponse := make([]byte, len(response))
+	if _, err := io.ReadFull(clientConn, receivedResponse); err != nil {
+		t.Fatalf("client Read: %v", err)
+	}
+
+	if err := <-serverResult; err != nil {
+		t.Fatalf("server side: %v", err)
+	}
+	if gotDestination.String() != destination.String() {
+		t.Fatalf("destination mismatch: got %s, want %s", gotDestination, destination)
+	}
+	if !bytes.Equal(receivedRequest, request) {
+		t.Fatalf("request payload mismatch: got %q, want %q", receivedRequest, request)
+	}
+	if !bytes.Equal(receivedResponse, response) {
+		t.Fatalf("response payload mismatch: got %q, want %q", receivedResponse, response)
+	}
+}